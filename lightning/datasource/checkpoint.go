@@ -0,0 +1,183 @@
+package datasource
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// RegionCheckpoint persists the region plan RegionFounder computes for a
+// table, so a restart can skip re-splitting every data file (which for a
+// multi-TB dataset can take minutes) and resume from the last known-good
+// plan instead, as long as the source files haven't changed underneath it.
+type RegionCheckpoint interface {
+	// Save stores regions as the latest plan for (db, table), tagged with
+	// filesFingerprint so a later Load can tell whether the source data
+	// has moved on since.
+	Save(db, table string, regions []*TableRegion, filesFingerprint string) error
+
+	// Load returns the last saved plan for (db, table) along with the
+	// fingerprint it was saved under. It returns a nil slice and no error
+	// if nothing has been saved yet.
+	Load(db, table string) ([]*TableRegion, string, error)
+}
+
+// computeFilesFingerprint hashes each data file's (path, size, mtime) so
+// RegionFounder can tell whether a checkpointed region plan is still valid.
+func computeFilesFingerprint(dataFiles []string) (string, error) {
+	h := sha256.New()
+	for _, file := range dataFiles {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s|%d|%d\n", file, stat.Size(), stat.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+////////////////////////////////////////////////////////////////
+
+// checkpointRecord is the JSON-serializable form a region plan is saved as.
+type checkpointRecord struct {
+	FilesFingerprint string         `json:"files_fingerprint"`
+	Regions          []*TableRegion `json:"regions"`
+}
+
+////////////////////////////////////////////////////////////////
+
+// FileRegionCheckpoint stores one region plan per (db, table) as a JSON
+// file under Dir.
+type FileRegionCheckpoint struct {
+	Dir string
+}
+
+func NewFileRegionCheckpoint(dir string) *FileRegionCheckpoint {
+	return &FileRegionCheckpoint{Dir: dir}
+}
+
+func (c *FileRegionCheckpoint) path(db, table string) string {
+	return filepath.Join(c.Dir, fmt.Sprintf("%s.%s.region-checkpoint.json", db, table))
+}
+
+// Save writes the checkpoint via write-to-temp-then-rename, so a crash
+// mid-write can never leave a truncated/corrupt checkpoint file behind for
+// Load to trip over.
+func (c *FileRegionCheckpoint) Save(db, table string, regions []*TableRegion, filesFingerprint string) error {
+	record := checkpointRecord{FilesFingerprint: filesFingerprint, Regions: regions}
+	data, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+
+	path := c.path(db, table)
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func (c *FileRegionCheckpoint) Load(db, table string) ([]*TableRegion, string, error) {
+	data, err := ioutil.ReadFile(c.path(db, table))
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	var record checkpointRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, "", err
+	}
+	return record.Regions, record.FilesFingerprint, nil
+}
+
+////////////////////////////////////////////////////////////////
+
+// MySQLRegionCheckpoint stores region plans in a MySQL table, following the
+// same checkpoint-driver pattern lightning uses for its other progress
+// checkpoints: one row per (db, table), with the plan itself kept as JSON.
+type MySQLRegionCheckpoint struct {
+	db        *sql.DB
+	tableName string
+}
+
+// NewMySQLRegionCheckpoint wraps db and ensures the checkpoint table
+// (tableName, e.g. "lightning_checkpoint.region_plan") exists.
+func NewMySQLRegionCheckpoint(db *sql.DB, tableName string) (*MySQLRegionCheckpoint, error) {
+	c := &MySQLRegionCheckpoint{db: db, tableName: tableName}
+	if err := c.ensureTable(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *MySQLRegionCheckpoint) ensureTable() error {
+	_, err := c.db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			db_name VARCHAR(255) NOT NULL,
+			table_name VARCHAR(255) NOT NULL,
+			files_fingerprint VARCHAR(64) NOT NULL,
+			regions_json LONGTEXT NOT NULL,
+			PRIMARY KEY (db_name, table_name)
+		)`, c.tableName))
+	return err
+}
+
+func (c *MySQLRegionCheckpoint) Save(db, table string, regions []*TableRegion, filesFingerprint string) error {
+	data, err := json.Marshal(regions)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf(`
+		REPLACE INTO %s (db_name, table_name, files_fingerprint, regions_json)
+		VALUES (?, ?, ?, ?)`, c.tableName),
+		db, table, filesFingerprint, string(data))
+	return err
+}
+
+func (c *MySQLRegionCheckpoint) Load(db, table string) ([]*TableRegion, string, error) {
+	row := c.db.QueryRow(fmt.Sprintf(`
+		SELECT files_fingerprint, regions_json FROM %s
+		WHERE db_name = ? AND table_name = ?`, c.tableName),
+		db, table)
+
+	var filesFingerprint, regionsJSON string
+	switch err := row.Scan(&filesFingerprint, &regionsJSON); err {
+	case sql.ErrNoRows:
+		return nil, "", nil
+	case nil:
+	default:
+		return nil, "", err
+	}
+
+	var regions []*TableRegion
+	if err := json.Unmarshal([]byte(regionsJSON), &regions); err != nil {
+		return nil, "", err
+	}
+	return regions, filesFingerprint, nil
+}
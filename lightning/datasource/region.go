@@ -1,13 +1,66 @@
 package datasource
 
 import (
+	"bufio"
+	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
 	"sync"
+	"time"
 
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/pingcap/tidb-lightning/lightning/metrics"
+)
+
+// tableRegionSizeWarningThreshold is the region size above which we warn the
+// user that a data file is not being split and should probably be
+// pre-sharded, because it is too large to import efficiently as one region.
+const tableRegionSizeWarningThreshold = 1 << 30 // 1 GiB
+
+// Compression identifies the codec a data file is compressed with. A data
+// file recognized as compressed is never seeked into; it is always imported
+// as a single region, read from front to back.
+const (
+	CompressionNone   = ""
+	CompressionGzip   = "gzip"
+	CompressionSnappy = "snappy"
+	CompressionZstd   = "zstd"
+)
+
+// detectCompression infers a data file's compression codec from its
+// extension. An unrecognized extension is treated as uncompressed.
+func detectCompression(file string) string {
+	switch filepath.Ext(file) {
+	case ".gz":
+		return CompressionGzip
+	case ".snappy":
+		return CompressionSnappy
+	case ".zst":
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
+
+// largeCSVLowerThresholdRatio is the multiple of minRegionSize above which a
+// CSV file is considered "large" and gets split into parallel sub-regions
+// instead of being processed by a single sequential reader.
+const largeCSVLowerThresholdRatio = 10
+
+// csv row-boundary scanning parameters. These match the defaults lightning
+// uses when no explicit CSV dialect is configured.
+const (
+	csvQuote    = '"'
+	csvEscape   = '"'
+	csvRowDelim = '\n'
 )
 
 type TableRegion struct {
@@ -21,6 +74,18 @@ type TableRegion struct {
 	Size       int64
 	BeginRowID int64
 	Rows       int64
+
+	// Compression is the codec the source file is compressed with (one of
+	// the Compression* constants), or CompressionNone for a plain file.
+	// Compressed files cannot be seeked into, so they are always imported
+	// as a single region covering the whole file.
+	Compression string
+
+	// EngineID groups regions that should be imported through the same
+	// engine file. Regions are assigned to engines in the order they are
+	// sorted, so BeginRowID stays monotonic across the whole table
+	// regardless of how many engines it ends up split into.
+	EngineID int32
 }
 
 func (reg *TableRegion) Name() string {
@@ -46,11 +111,35 @@ func (rs regionSlice) Less(i, j int) bool {
 ////////////////////////////////////////////////////////////////
 
 type RegionFounder struct {
-	processors    chan int
-	minRegionSize int64
+	processors      chan int
+	minRegionSize   int64
+	batchImportSize int64
+	checkpoint      RegionCheckpoint
+	warnRegionSize  int64
+}
+
+// SetCheckpoint attaches a RegionCheckpoint that MakeTableRegions will
+// consult before splitting a table, and update after, so a restart with
+// unchanged source files can skip splitting entirely. Passing nil disables
+// checkpointing.
+func (f *RegionFounder) SetCheckpoint(checkpoint RegionCheckpoint) {
+	f.checkpoint = checkpoint
+}
+
+// SetWarnRegionSize overrides the region size above which MakeTableRegions
+// warns and increments metrics.RegionOversizeTotal. It defaults to
+// tableRegionSizeWarningThreshold (1 GiB).
+func (f *RegionFounder) SetWarnRegionSize(warnRegionSize int64) {
+	f.warnRegionSize = warnRegionSize
 }
 
-func NewRegionFounder(minRegionSize int64) *RegionFounder {
+// NewRegionFounder creates a RegionFounder that splits table data into
+// regions of roughly minRegionSize bytes, and groups those regions into
+// engines of at most batchImportSize bytes each (see EngineID on
+// TableRegion); a single region larger than batchImportSize forms an engine
+// on its own. A non-positive batchImportSize disables engine batching,
+// assigning every region of a table to engine 0.
+func NewRegionFounder(minRegionSize int64, batchImportSize int64) *RegionFounder {
 	concurrency := runtime.NumCPU() >> 1
 	if concurrency == 0 {
 		concurrency = 1
@@ -62,12 +151,14 @@ func NewRegionFounder(minRegionSize int64) *RegionFounder {
 	}
 
 	return &RegionFounder{
-		processors:    processors,
-		minRegionSize: minRegionSize,
+		processors:      processors,
+		minRegionSize:   minRegionSize,
+		batchImportSize: batchImportSize,
+		warnRegionSize:  tableRegionSizeWarningThreshold,
 	}
 }
 
-func (f *RegionFounder) MakeTableRegions(meta *MDTableMeta, allocateRowID bool, sourceType string) []*TableRegion {
+func (f *RegionFounder) MakeTableRegions(meta *MDTableMeta, allocateRowID bool, sourceType string) (result []*TableRegion) {
 	var lock sync.Mutex
 	var wg sync.WaitGroup
 
@@ -75,6 +166,28 @@ func (f *RegionFounder) MakeTableRegions(meta *MDTableMeta, allocateRowID bool,
 	table := meta.Name
 	processors := f.processors
 	minRegionSize := f.minRegionSize
+	largeCSVThreshold := minRegionSize * largeCSVLowerThresholdRatio
+
+	start := time.Now()
+	defer func() {
+		metrics.RegionSplitDuration.WithLabelValues(table).Observe(time.Since(start).Seconds())
+	}()
+
+	var filesFingerprint string
+	if f.checkpoint != nil {
+		var err error
+		filesFingerprint, err = computeFilesFingerprint(meta.DataFiles)
+		if err != nil {
+			log.Errorf("[%s] failed to fingerprint data files, skipping region checkpoint : %s", table, err.Error())
+		} else if cached, savedFingerprint, err := f.checkpoint.Load(db, table); err != nil {
+			log.Errorf("[%s] failed to load region checkpoint : %s", table, err.Error())
+		} else if len(cached) > 0 && savedFingerprint == filesFingerprint {
+			log.Infof("[%s] reusing checkpointed region plan (%d regions)", table, len(cached))
+			metrics.RegionsTotal.WithLabelValues(table, "cached").Add(float64(len(cached)))
+			f.observeRegionSizes(db, table, cached)
+			return cached
+		}
+	}
 
 	// Split files into regions
 	filesRegions := make(regionSlice, 0, len(meta.DataFiles))
@@ -84,11 +197,21 @@ func (f *RegionFounder) MakeTableRegions(meta *MDTableMeta, allocateRowID bool,
 			log.Debugf("[%s] loading file's region (%s) ...", table, file)
 
 			var regions []*TableRegion
-			if allocateRowID {
+			var mode string
+			if compression := detectCompression(file); compression != CompressionNone {
+				regions = splitCompressedRegion(sourceType, db, table, file, compression)
+				mode = "compressed"
+			} else if sourceType == "csv" && !allocateRowID && isLargeCSVFile(file, largeCSVThreshold) {
+				regions = splitLargeCSVRegion(db, table, file, minRegionSize)
+				mode = "large-csv"
+			} else if allocateRowID {
 				regions = splitExactRegion(sourceType, db, table, file, minRegionSize)
+				mode = "exact"
 			} else {
 				regions = splitFuzzyRegion(sourceType, db, table, file, minRegionSize)
+				mode = "fuzzy"
 			}
+			metrics.RegionsTotal.WithLabelValues(table, mode).Add(float64(len(regions)))
 
 			lock.Lock()
 			filesRegions = append(filesRegions, regions...)
@@ -116,10 +239,166 @@ func (f *RegionFounder) MakeTableRegions(meta *MDTableMeta, allocateRowID bool,
 			region.BeginRowID = -1
 		}
 	}
+	f.observeRegionSizes(db, table, filesRegions)
+
+	// Group the globally row-ID'd regions into engines, so the caller can
+	// open, import and clean up several engine files per table concurrently
+	// instead of funnelling every region through a single engine.
+	assignEngineIDs(filesRegions, f.batchImportSize)
+
+	if f.checkpoint != nil && filesFingerprint != "" {
+		if err := f.checkpoint.Save(db, table, filesRegions, filesFingerprint); err != nil {
+			log.Errorf("[%s] failed to save region checkpoint : %s", table, err.Error())
+		}
+	}
 
 	return filesRegions
 }
 
+// observeRegionSizes records metrics.RegionSizeBytes and the oversize
+// warning/metrics.RegionOversizeTotal for every region in regions. It is
+// shared by the freshly-split path and the checkpoint cache-hit path in
+// MakeTableRegions, so observability doesn't go dark on the common case of
+// a warm checkpoint (where splitting, and thus the per-file metrics, never
+// runs).
+func (f *RegionFounder) observeRegionSizes(db, table string, regions []*TableRegion) {
+	for _, region := range regions {
+		metrics.RegionSizeBytes.Observe(float64(region.Size))
+		if region.Size > f.warnRegionSize {
+			log.Warnf("[%s.%s] region (file=%s, offset=%d) is %d bytes, which exceeds the %d-byte warning threshold; consider re-sharding this dump",
+				db, table, region.File, region.Offset, region.Size, f.warnRegionSize)
+			metrics.RegionOversizeTotal.Inc()
+		}
+	}
+}
+
+// assignEngineIDs partitions the already sorted, row-ID'd regions into
+// consecutive engine groups whose cumulative Size does not exceed
+// batchImportSize, numbering the groups 0, 1, 2, ... in region order. A
+// region that is by itself larger than batchImportSize gets an engine of
+// its own, which then exceeds the limit. A non-positive batchImportSize
+// puts every region into engine 0.
+func assignEngineIDs(regions []*TableRegion, batchImportSize int64) {
+	if batchImportSize <= 0 {
+		for _, region := range regions {
+			region.EngineID = 0
+		}
+		return
+	}
+
+	var engineID int32
+	var engineSize int64
+	for _, region := range regions {
+		if engineSize > 0 && engineSize+region.Size > batchImportSize {
+			engineID++
+			engineSize = 0
+		}
+		region.EngineID = engineID
+		engineSize += region.Size
+	}
+}
+
+// newCompressionReader wraps src with the decoder for compression, so
+// callers read the actual uncompressed byte stream instead of the raw
+// compressed bytes on disk.
+func newCompressionReader(compression string, src io.Reader) (io.Reader, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(src)
+	case CompressionSnappy:
+		return snappy.NewReader(src), nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		return zr, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+// decompressToTempFile decompresses file (compressed with compression) into
+// a temporary plain file and returns its path, so the regular NewDataReader
+// parsing path can run over real, uncompressed bytes. The caller owns the
+// returned file and must remove it once done.
+func decompressToTempFile(file, compression string) (string, error) {
+	src, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	decoder, err := newCompressionReader(compression, bufio.NewReader(src))
+	if err != nil {
+		return "", err
+	}
+	if closer, ok := decoder.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	tmp, err := ioutil.TempFile("", "lightning-decompressed-")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, decoder); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// splitCompressedRegion decompresses a compressed data file, streams the
+// decompressed bytes front to back, and returns the whole thing as a single
+// TableRegion, since a compressed stream cannot be seeked into to find
+// further split points. Rows are counted over the real decompressed content,
+// so BeginRowID assignment works the same as for an uncompressed file.
+func splitCompressedRegion(sourceType string, db string, table string, file string, compression string) []*TableRegion {
+	tmpFile, err := decompressToTempFile(file, compression)
+	if err != nil {
+		log.Errorf("failed to decompress file (%s) : %s", file, err.Error())
+		return nil
+	}
+	defer os.Remove(tmpFile)
+
+	reader, err := NewDataReader(sourceType, tmpFile, 0)
+	if err != nil {
+		log.Errorf("failed to generate file's regions  (%s) : %s", file, err.Error())
+		return nil
+	}
+	defer reader.Close()
+
+	region := &TableRegion{
+		ID:          -1,
+		DB:          db,
+		Table:       table,
+		File:        file,
+		Offset:      0,
+		Size:        0,
+		BeginRowID:  0,
+		Rows:        0,
+		Compression: compression,
+	}
+
+	for {
+		statements, err := reader.Read(defReadBlockSize)
+		if err == io.EOF {
+			break
+		}
+		region.Size = reader.Tell()
+		for _, stmt := range statements {
+			region.Rows += int64(countValues(stmt))
+		}
+	}
+
+	// Oversize warning/metrics are handled centrally by MakeTableRegions
+	// (against the configurable f.warnRegionSize), not here.
+	return []*TableRegion{region}
+}
+
 func splitFuzzyRegion(sourceType string, db string, table string, file string, minRegionSize int64) []*TableRegion {
 	reader, err := NewDataReader(sourceType, file, 0)
 	if err != nil {
@@ -226,3 +505,166 @@ func splitExactRegion(sourceType string, db string, table string, file string, m
 
 	return regions
 }
+
+// isLargeCSVFile reports whether file is big enough to be worth splitting
+// into multiple parallel sub-regions instead of processing it serially.
+func isLargeCSVFile(file string, threshold int64) bool {
+	stat, err := os.Stat(file)
+	if err != nil {
+		log.Errorf("failed to stat file (%s) : %s", file, err.Error())
+		return false
+	}
+	return stat.Size() > threshold
+}
+
+// splitLargeCSVRegion breaks a single large CSV file into several
+// row-boundary-aligned sub-regions of roughly minRegionSize each, so that it
+// can be imported through multiple workers concurrently instead of blocking
+// behind one sequential reader. Every boundary is snapped forward to the
+// start of a real CSV record, so no row is ever split across two regions.
+//
+// Building each TableRegion here is pure arithmetic over boundaries already
+// computed by findCSVRecordBoundaries, so it's done as a plain loop rather
+// than fanning out a goroutine per sub-region. The sub-regions are not
+// passed through the processors channel one by one: the whole file takes a
+// single processor slot in MakeTableRegions, and the regions are returned
+// to the caller, which can then import them in parallel.
+//
+// Rows is only ever seeded here with a sampled estimate, never an exact
+// count, so MakeTableRegions only takes this path when allocateRowID is
+// false: BeginRowID assignment needs every region's real row count to stay
+// globally unique and contiguous, which an estimate cannot guarantee. When
+// allocateRowID is true, an oversized CSV file falls back to the slower but
+// exact splitExactRegion instead.
+func splitLargeCSVRegion(db string, table string, file string, minRegionSize int64) []*TableRegion {
+	stat, err := os.Stat(file)
+	if err != nil {
+		log.Errorf("failed to stat file (%s) : %s", file, err.Error())
+		return nil
+	}
+	fileSize := stat.Size()
+
+	boundaries, err := findCSVRecordBoundaries(file, fileSize, minRegionSize)
+	if err != nil {
+		log.Errorf("failed to split large CSV file's region (%s) : %s", file, err.Error())
+		return nil
+	}
+
+	avgRowLength := sampleAvgCSVRowLength(file, minRegionSize)
+
+	regions := make([]*TableRegion, 0, len(boundaries)-1)
+	for i := 0; i < len(boundaries)-1; i++ {
+		offset := boundaries[i]
+		size := boundaries[i+1] - offset
+		regions = append(regions, &TableRegion{
+			ID:         -1,
+			DB:         db,
+			Table:      table,
+			File:       file,
+			Offset:     offset,
+			Size:       size,
+			BeginRowID: 0,
+			Rows:       estimateCSVRows(size, avgRowLength),
+		})
+	}
+
+	return regions
+}
+
+// estimateCSVRows gives an approximate row count for a sub-region sized
+// `size` bytes, based on the average row length sampled from the start of
+// the file. This is only a seed value: MakeTableRegions takes the large-CSV
+// path only when allocateRowID is false, so no BeginRowID is derived from
+// it. It returns -1 (unknown) when no average row length could be sampled.
+func estimateCSVRows(size, avgRowLength int64) int64 {
+	if avgRowLength <= 0 {
+		return -1
+	}
+	return size / avgRowLength
+}
+
+// sampleAvgCSVRowLength reads a block from the start of file and returns the
+// average number of bytes per row delimiter found in it.
+func sampleAvgCSVRowLength(file string, sampleSize int64) int64 {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Errorf("failed to sample file (%s) : %s", file, err.Error())
+		return 0
+	}
+	defer f.Close()
+
+	if sampleSize > defReadBlockSize {
+		sampleSize = defReadBlockSize
+	}
+	buf := make([]byte, sampleSize)
+	n, err := f.Read(buf)
+	if err != nil && err != io.EOF {
+		log.Errorf("failed to sample file (%s) : %s", file, err.Error())
+		return 0
+	}
+
+	var rows int64
+	for i := 0; i < n; i++ {
+		if buf[i] == csvRowDelim {
+			rows++
+		}
+	}
+	if rows == 0 {
+		return int64(n)
+	}
+	return int64(n) / rows
+}
+
+// findCSVRecordBoundaries scans file front to back exactly once, tracking
+// quoted-field state continuously from byte 0, and returns the record-start
+// offsets (including 0 and fileSize) that lie just past the first unquoted
+// row delimiter at or beyond each minRegionSize stride, measured from the
+// previous boundary. A quoted field (and doubled-quote
+// escapes within it) can never be mistaken for a record terminator, because
+// unlike seeking to an approximate offset and guessing the quote state
+// there, this never loses track of it: every byte between two boundaries is
+// actually read.
+func findCSVRecordBoundaries(file string, fileSize, minRegionSize int64) ([]int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, int(defReadBlockSize))
+	boundaries := []int64{0}
+	nextTarget := minRegionSize
+	inQuote := false
+
+	var offset int64
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset++
+
+		switch {
+		case b == csvQuote:
+			if inQuote {
+				if peek, peekErr := r.Peek(1); peekErr == nil && peek[0] == csvEscape {
+					r.ReadByte() // doubled-quote escape sequence, stays inside the field
+					offset++
+					continue
+				}
+			}
+			inQuote = !inQuote
+		case b == csvRowDelim && !inQuote:
+			if offset >= nextTarget && offset < fileSize {
+				boundaries = append(boundaries, offset)
+				nextTarget = offset + minRegionSize
+			}
+		}
+	}
+	boundaries = append(boundaries, fileSize)
+
+	return boundaries, nil
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// RegionSplitDuration tracks how long RegionFounder.MakeTableRegions takes
+// to produce a table's region plan, so the splitting phase stops being an
+// opaque gap in a lightning run.
+var RegionSplitDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "lightning",
+		Name:      "region_split_duration_seconds",
+		Help:      "Time spent splitting a table's data files into regions",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 20),
+	},
+	[]string{"table"},
+)
+
+// RegionsTotal counts how many regions each table was split into, broken
+// down by the splitting mode that produced them.
+var RegionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "lightning",
+		Name:      "regions_total",
+		Help:      "Number of regions produced per table",
+	},
+	[]string{"table", "mode"},
+)
+
+// RegionSizeBytes is the distribution of emitted region sizes, across all
+// tables, used to spot dumps that are producing abnormally large regions.
+var RegionSizeBytes = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "lightning",
+		Name:      "region_size_bytes",
+		Help:      "Size in bytes of each region RegionFounder produces",
+		Buckets:   prometheus.ExponentialBuckets(1<<20, 2, 16), // 1 MiB .. 32 GiB
+	},
+)
+
+// RegionOversizeTotal counts regions whose size exceeded
+// RegionFounder.warnRegionSize, each of which is also logged with its
+// DB/table/file/offset so operators know which dumps need re-sharding.
+var RegionOversizeTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "lightning",
+		Name:      "region_oversize_total",
+		Help:      "Number of regions that exceeded the region size warning threshold",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(RegionSplitDuration)
+	prometheus.MustRegister(RegionsTotal)
+	prometheus.MustRegister(RegionSizeBytes)
+	prometheus.MustRegister(RegionOversizeTotal)
+}